@@ -0,0 +1,61 @@
+package main
+
+// vim: ts=2 sw=2 ai
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+
+	cc "github.com/fayep/cmdcache/pkg/cmdcache"
+	"github.com/vmihailenco/msgpack"
+)
+
+// sockPathFor returns the unix socket path a --serve run listens on,
+// derived from the same hash that names its cache file.
+func sockPathFor(hash string) string {
+	return path.Join(os.Getenv("HOME"), ".cmdcache", hash+".ts.sock")
+}
+
+// doAttach dials the socket for a running --serve capture and renders
+// the records as they arrive, the same way the replay path does, so
+// you can peek at a job before it finishes.
+func doAttach(hash string) {
+	sock := sockPathFor(hash)
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cmdcache: no running capture for %s (%s)\n", hash, err)
+		panic(Exit{1})
+	}
+	defer conn.Close()
+	mp := msgpack.NewDecoder(conn)
+	for {
+		var rec cc.BufRecord
+		if err := mp.Decode(&rec); err != nil {
+			// Socket closed: the run finished or was interrupted.
+			panic(Exit{0})
+		}
+		buf := rec.Buf
+		switch rec.Id {
+		case cc.StreamStdout:
+			fmt.Printf("%s", string(buf))
+		case cc.StreamStderr:
+			fmt.Fprintf(os.Stderr, "%s", string(buf))
+		// terminal resize, recorded by --pty - same handling as the
+		// replay path in main.go.
+		case cc.ResizeRecordID:
+			if ws, err := cc.DecodeResize(buf); err == nil {
+				fmt.Printf("%s", cc.ResizeEscape(ws))
+			}
+		// why the run was signaled, recorded by --timeout/--kill-after
+		// or a forwarded SIGINT/SIGTERM/SIGHUP/SIGQUIT
+		case cc.SignalRecordID:
+			if ti, err := cc.DecodeTermInfo(buf); err == nil {
+				fmt.Fprintf(os.Stderr, "cmdcache: process was sent signal %d\n", ti.Signal)
+			}
+		case cc.ExitRecordID:
+			panic(Exit{int(buf[0])})
+		}
+	}
+}
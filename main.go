@@ -4,19 +4,16 @@ package main
 
 import (
 	"compress/gzip"
-	"crypto/md5"
 	"flag"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
-	"syscall"
 	"time"
 
-	"github.com/vmihailenco/msgpack"
+	cc "github.com/fayep/cmdcache/pkg/cmdcache"
 )
 
 // Exit struct is used to panic with an exit code
@@ -32,75 +29,14 @@ func handleExit() {
 	}
 }
 
-// BufRecord is how we shunt data around
-type BufRecord struct {
-	T   int
-	Id  int
-	Buf []byte
-}
-
-// Timestamped is the type for our timestamped stream
-type Timestamped struct {
-	t  time.Time
-	id int
-	ch chan BufRecord
-}
-
-// OpenTS is how we setup a Timestamped stream
-func OpenTS(id int, c chan BufRecord) *Timestamped {
-	return &Timestamped{time.Now(), id, c}
-}
+// stringList implements flag.Value for options that can be repeated,
+// like --env-key and --dep.
+type stringList []string
 
-// Write for Timestamped stream - as this is multiplexed,
-// we send it to the channel for writing in one place.
-func (t *Timestamped) Write(d []byte) (int, error) {
-	tn := time.Now()
-	dif := int64(tn.Sub(t.t) / time.Millisecond)
-	t.t = tn
-	data := []byte{}
-	copy(data, d)
-	rec := BufRecord{T: int(dif), Id: t.id, Buf: d}
-	n := len(d)
-	t.ch <- rec
-	return n, nil
-}
-
-// DurationOf is so named because I was originally using a duration
-// type, but the way of asserting the value was so unsatisfying
-// Probably the messagepack library's fault.
-// Here I work around the whole issue that msgpack won't tell me
-// what type it's going to use to store the value by utilizing
-// printf's reflective capabilities.  Anyway, since I am now using
-// Milliseconds, it's still a duration, but not a Duration.
-func DurationOf(i interface{}) int {
-	var d int
-	// There's probably a better way.
-	s := fmt.Sprintf("%v", i)
-	fmt.Sscanf(s, "%d", &d)
-	return d
-}
-
-// plex marshals and sequences the record into the writer for the channel
-// This is usually the same for both stdout and stderr so that's why
-// we use the channel to keep writes coherent.
-// f is usually a gzip writer with an actual file underneath
-// they need time to finish flushing so we emit a finished signal
-// which the main process blocks on.
-func plex(f io.Writer, ch chan BufRecord, finished chan bool) {
-	for {
-		// Receive a record from the channel
-		rec := <-ch
-		if out, err := msgpack.Marshal(rec); err == nil {
-			// Write a good record to the file
-			f.Write(out)
-			// If this is the exit code, we're done.
-			if rec.Id == 127 {
-				// Signal the end so that we can wait for it.
-				finished <- true
-				return
-			}
-		}
-	}
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
 }
 
 func main() {
@@ -112,7 +48,25 @@ func main() {
 	ttlPtr := flag.Int("ttl", -1, "time to live in seconds")
 	delayPtr := flag.Bool("delay", false, "'real time' display")
 	keepNeg := flag.Bool("ve", false, "cache non-zero exit codes")
+	servePtr := flag.Bool("serve", false, "expose the live capture on a unix socket for --attach")
+	attachPtr := flag.String("attach", "", "attach to a running --serve capture by its hash")
+	formatPtr := flag.String("format", "native", "capture/replay format: native or asciicast")
+	ptyPtr := flag.Bool("pty", false, "run the command in a pseudo-terminal, for isatty-sensitive programs")
+	timeoutPtr := flag.Duration("timeout", 0, "kill the command with SIGTERM after this long (0 disables)")
+	killAfterPtr := flag.Duration("kill-after", 0, "if --timeout's SIGTERM hasn't worked after this long, send SIGKILL")
+	whyPtr := flag.String("why", "", "explain what inputs produced a cache key's hash")
+	hashStdinPtr := flag.Bool("hash-stdin", false, "fold a sha256 of stdin into the cache key")
+	var envKeys stringList
+	flag.Var(&envKeys, "env-key", "env var glob pattern to fold into the cache key (repeatable)")
+	var deps stringList
+	flag.Var(&deps, "dep", "file whose mtime/size/sha256 should be folded into the cache key (repeatable)")
 	flag.Parse()
+	if *attachPtr != "" {
+		doAttach(*attachPtr)
+	}
+	if *whyPtr != "" {
+		doWhy(*whyPtr)
+	}
 	if flag.NArg() == 0 {
 		fmt.Printf(`Usage: %s [options] command [arguments]
 Execute command with arguments and cache the output.
@@ -126,114 +80,164 @@ Options:
 	// These are just the barewords after any options so they are
 	// definitely the program and arguments to run.
 	args := flag.Args()
-	digest := md5.Sum([]byte(strings.Join(args, " ")))
-	filename := fmt.Sprintf("%x", digest) + ".ts"
+
+	// Stdin can only be read once, so if it's part of the key we have
+	// to buffer and hash it before we even know whether this is a hit,
+	// then replay it to the child ourselves on a miss.
+	var stdinFile *os.File
+	var stdinSHA string
+	if *hashStdinPtr {
+		var err error
+		stdinFile, stdinSHA, err = cc.BufferStdin()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cmdcache: couldn't buffer stdin: %s\n", err)
+			panic(Exit{1})
+		}
+		defer stdinFile.Close()
+	}
+
+	digest, meta, err := cc.DeriveKey(args, envKeys, deps, stdinSHA)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cmdcache: couldn't derive cache key: %s\n", err)
+		panic(Exit{1})
+	}
+	filename := digest + cc.ExtensionFor(*formatPtr)
 	location := path.Join(os.Getenv("HOME"), ".cmdcache", filename)
 
 	if stat, err := os.Stat(location); err == nil &&
 		(*ttlPtr == -1 ||
 			int(time.Now().Sub(stat.ModTime())/time.Second) <= *ttlPtr) {
-		f, _ := os.Open(location)
-		defer f.Close()
-		gz, _ := gzip.NewReader(f)
-		defer gz.Close()
-		mp := msgpack.NewDecoder(gz)
+		player, err := cc.Open(location)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cmdcache: couldn't read cache file: %s\n", err)
+			panic(Exit{1})
+		}
+		defer player.Close()
 		var exitCode int
 		for {
-			if i, err := mp.DecodeInterface(); err == nil {
-				// I don't bother to decode back to the original
-				// Just assert the appropriate content.
-				rec := i.(map[string]interface{})
-				id := rec["Id"].(int8)
-				buf := rec["Buf"].([]byte)
-				// Do we want to slow down the output?
-				if *delayPtr {
-					T := DurationOf(rec["T"])
-					time.Sleep(time.Duration(T) * time.Millisecond)
+			rec, err := player.Next()
+			if err == io.EOF {
+				panic(Exit{exitCode})
+			}
+			// Do we want to slow down the output?
+			if *delayPtr {
+				time.Sleep(time.Duration(rec.T) * time.Millisecond)
+			}
+			switch rec.Id {
+			// stdout
+			case cc.StreamStdout:
+				fmt.Printf("%s", string(rec.Buf))
+			// stderr
+			case cc.StreamStderr:
+				fmt.Fprintf(os.Stderr, "%s", string(rec.Buf))
+			// terminal resize, recorded by --pty
+			case cc.ResizeRecordID:
+				if ws, err := cc.DecodeResize(rec.Buf); err == nil {
+					fmt.Printf("%s", cc.ResizeEscape(ws))
 				}
-				switch id {
-				// stdout
-				case 1:
-					fmt.Printf("%s", string(buf))
-				// stderr
-				case 2:
-					fmt.Fprintf(os.Stderr, "%s", string(buf))
-				// exitcode
-				case 127:
-					exitCode = int(buf[0])
+			// why the run was signaled, recorded by --timeout/--kill-after
+			// or a forwarded SIGINT/SIGTERM/SIGHUP/SIGQUIT
+			case cc.SignalRecordID:
+				if ti, err := cc.DecodeTermInfo(rec.Buf); err == nil {
+					fmt.Fprintf(os.Stderr, "cmdcache: process was sent signal %d\n", ti.Signal)
 				}
-			} else {
-				// end of stream reached
-				panic(Exit{exitCode})
+			// exitcode
+			case cc.ExitRecordID:
+				exitCode = int(rec.Buf[0])
 			}
 		}
 	} else {
 		// Create the file
 		f, _ := os.Create(location)
 		defer f.Close()
-		// Setup the command to run
-		cmd := exec.Command(args[0], args[1:]...)
-		// Pass our standard input through
-		cmd.Stdin = os.Stdin
-		// Create pipes for stdout and stderr
-		stdoutIn, _ := cmd.StdoutPipe()
-		stderrIn, _ := cmd.StderrPipe()
-		// Create channels for data and signalling
-		ch := make(chan BufRecord)
-		finished := make(chan bool)
-		// Overlay compression on our file writer
-		compressedStdout := gzip.NewWriter(f)
-		defer compressedStdout.Close()
-		// Setup tee to our timestamper and console
-		stdout := io.MultiWriter(OpenTS(1, ch), os.Stdout)
-		stderr := io.MultiWriter(OpenTS(2, ch), os.Stderr)
-		// Start our program!
-		er := cmd.Start()
-		// Did we fail to start?
-		if er != nil {
-			// We shouldn't keep this file, it will erase properly on close.
-			os.Remove(location)
-			fmt.Fprintf(os.Stderr, "cmd.Start() failed with '%s'\n", er)
+		keepCache := true
+		// Pick the sink that matches --format: the native format
+		// overlays gzip compression on the file, asciicast is plain
+		// JSON lines so other tools can read it directly.
+		var sink cc.RecordSink
+		if *formatPtr == "asciicast" {
+			castSink, err := cc.NewCastSink(f, time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cmdcache: couldn't write .cast header: %s\n", err)
+				panic(Exit{1})
+			}
+			sink = castSink
+		} else {
+			compressedStdout := gzip.NewWriter(f)
+			defer compressedStdout.Close()
+			sink = cc.NativeSink{W: compressedStdout}
 		}
 
-		// Be ready to handle output created by below io.Copy
-		go plex(compressedStdout, ch, finished)
-
-		var errStdout, errStderr error
-
-		// Copies until eof then exits
-		go func() {
-			_, errStdout = io.Copy(stdout, stdoutIn)
-		}()
+		// If asked, expose the live stream on a unix socket so that
+		// `cmdcache --attach <hash>` can tail this run before it finishes.
+		var bc *cc.WriteBroadcaster
+		var serveDone chan bool
+		if *servePtr {
+			bc = cc.NewWriteBroadcaster()
+			serveDone = make(chan bool)
+			go bc.Serve(sockPathFor(digest), serveDone)
+			defer close(serveDone)
+		}
 
-		// Copies until eof then exits
-		go func() {
-			_, errStderr = io.Copy(stderr, stderrIn)
-		}()
+		// The CLI is a thin wrapper around a Recorder: point it at the
+		// right stdin and --pty/--timeout/--kill-after options, then
+		// fan its Stream() out to the cache sink, --serve's
+		// broadcaster, and the real terminal - the same three places
+		// the replay loop above sends a cache-hit's records.
+		rec := cc.New(args[0], args[1:]...)
+		rec.Stdin = os.Stdin
+		if stdinFile != nil {
+			// Replay the buffered copy instead - the original stdin
+			// was already consumed while deriving the cache key.
+			rec.Stdin = stdinFile
+		}
+		rec.PTY = *ptyPtr
+		rec.Timeout = *timeoutPtr
+		rec.KillAfter = *killAfterPtr
+		done := rec.Start()
 
-		// Wait for command to exit
-		er = cmd.Wait()
 		exitCode := 0
-		if exiterr, ok := er.(*exec.ExitError); ok {
-			// The program has exited with an exit code != 0
-
-			// This works on both Unix and Windows. Although package
-			// syscall is generally platform dependent, WaitStatus is
-			// defined for both Unix and Windows and in both cases has
-			// an ExitStatus() method with the same signature.
-			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				exitCode = status.ExitStatus()
+		for r := range rec.Stream() {
+			if bc != nil {
+				bc.Feed(r)
+			}
+			if err := sink.WriteRecord(r); err != nil {
+				fmt.Fprintf(os.Stderr, "cmdcache: couldn't write record: %s\n", err)
 			}
-			// Did the user want to preserve error responses?
-			if !*keepNeg {
-				os.Remove(location)
+			switch r.Id {
+			case cc.StreamStdout:
+				fmt.Printf("%s", string(r.Buf))
+			case cc.StreamStderr:
+				fmt.Fprintf(os.Stderr, "%s", string(r.Buf))
+			case cc.SignalRecordID:
+				if ti, err := cc.DecodeTermInfo(r.Buf); err == nil {
+					fmt.Fprintf(os.Stderr, "cmdcache: process was sent signal %d\n", ti.Signal)
+				}
+			case cc.ExitRecordID:
+				exitCode = int(r.Buf[0])
 			}
 		}
+		status := <-done
+
+		if status.Err != nil {
+			// The command failed to start, or a stdout/stderr copy
+			// genuinely errored rather than reaching its own io.EOF.
+			fmt.Fprintf(os.Stderr, "cmdcache: %s\n", status.Err)
+			os.Remove(location)
+			keepCache = false
+		}
+		// Did the user want to preserve error responses?
+		if exitCode != 0 && !*keepNeg {
+			os.Remove(location)
+			keepCache = false
+		}
 
-		// Write an exit code to the stream
-		ch <- BufRecord{T: 0, Id: 127, Buf: []byte{byte(exitCode)}}
-		// Synchronize with everything written and the goroutine exited
-		<-finished
+		// Record what went into this key so `--why` can explain it later.
+		if keepCache {
+			if err := cc.WriteMeta(digest, meta); err != nil {
+				fmt.Fprintf(os.Stderr, "cmdcache: couldn't write .meta: %s\n", err)
+			}
+		}
 		// Exit the program with an exit code, respecting defer
 		panic(Exit{exitCode})
 	}
@@ -0,0 +1,83 @@
+package cmdcache
+
+// vim: ts=2 sw=2 ai
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// WriteBroadcaster fans a stream of BufRecords out to any number of
+// subscribers that connect while a capture is still running.  Modeled
+// on gosuv's WriteBroadcaster: a slice of writers guarded by a mutex,
+// plus a backlog so a late joiner can be replayed the full session
+// before it starts seeing live records.
+type WriteBroadcaster struct {
+	mu      sync.Mutex
+	writers []io.Writer
+	backlog []BufRecord
+}
+
+// NewWriteBroadcaster makes an empty broadcaster, ready to Feed and Attach.
+func NewWriteBroadcaster() *WriteBroadcaster {
+	return &WriteBroadcaster{}
+}
+
+// Feed records rec for replay to future subscribers and fans it out to
+// everyone currently attached.  Subscribers that error out (the usual
+// case being they hung up) are dropped.
+func (b *WriteBroadcaster) Feed(rec BufRecord) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.backlog = append(b.backlog, rec)
+	out, err := msgpack.Marshal(rec)
+	if err != nil {
+		return
+	}
+	live := b.writers[:0]
+	for _, w := range b.writers {
+		if _, err := w.Write(out); err == nil {
+			live = append(live, w)
+		}
+	}
+	b.writers = live
+}
+
+// Attach registers w as a subscriber, first replaying the buffered
+// history so late joiners see the full session so far.
+func (b *WriteBroadcaster) Attach(w io.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, rec := range b.backlog {
+		if out, err := msgpack.Marshal(rec); err == nil {
+			w.Write(out)
+		}
+	}
+	b.writers = append(b.writers, w)
+}
+
+// Serve listens on the unix socket at sockPath and attaches every
+// connection that dials in as a subscriber, until done is closed.
+func (b *WriteBroadcaster) Serve(sockPath string, done chan bool) {
+	os.Remove(sockPath) // stale socket left behind by a crashed run
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return
+	}
+	go func() {
+		<-done
+		l.Close()
+		os.Remove(sockPath)
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		b.Attach(conn)
+	}
+}
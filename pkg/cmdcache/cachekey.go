@@ -0,0 +1,187 @@
+package cmdcache
+
+// vim: ts=2 sw=2 ai
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DepInfo is what we remember about a --dep FILE: its content hash
+// plus the mtime/size that let ReadMeta explain a miss without
+// re-hashing the file.
+type DepInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	SHA256  string
+}
+
+// KeyInputs records which inputs contributed to a cache key, so
+// ReadMeta can explain hits and misses after the fact.  It's
+// persisted alongside the cache file as a JSON sidecar.
+type KeyInputs struct {
+	Args     []string
+	Cwd      string
+	EnvKeys  map[string]string
+	StdinSHA string `json:",omitempty"`
+	Deps     []DepInfo
+	SHA256   string
+}
+
+// MetaPath returns the sidecar path that WriteMeta/ReadMeta use for a
+// given cache key digest.
+func MetaPath(digest string) string {
+	return path.Join(os.Getenv("HOME"), ".cmdcache", digest+".meta")
+}
+
+// HashDep stats and sha256-hashes a --dep file, so its content and
+// its mtime/size are both part of the key - the former so a changed
+// dependency invalidates the cache, the latter so ReadMeta can report
+// on a dependency without re-reading it.
+func HashDep(file string) (DepInfo, error) {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return DepInfo{}, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return DepInfo{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return DepInfo{}, err
+	}
+	return DepInfo{
+		Path:    file,
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+		SHA256:  hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// BufferStdin copies stdin to a temp file while hashing it, since we
+// need to know its sha256 before we can even decide whether this run
+// is a cache hit, but a pipe can only be read once - the returned file
+// is seeked back to the start, ready to be replayed to the child.
+func BufferStdin() (*os.File, string, error) {
+	tmp, err := ioutil.TempFile("", "cmdcache-stdin-")
+	if err != nil {
+		return nil, "", err
+	}
+	os.Remove(tmp.Name()) // unlink now, the fd keeps it alive until Close
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), os.Stdin); err != nil {
+		tmp.Close()
+		return nil, "", err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, "", err
+	}
+	return tmp, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DeriveKey streams every component that should affect the cache key,
+// in a stable order, into io.MultiWriter(md5, sha256): the argv vector
+// (length-prefixed so "a","bc" can't collide with "ab","c"), the
+// working directory, any env vars matching envKeys, a sha256 of stdin
+// when one is supplied, and the hash of each dep file.  md5 names the
+// cache file; sha256 goes into the KeyInputs returned for the .meta
+// sidecar, since md5 alone isn't much assurance once file contents are
+// part of the key.
+func DeriveKey(args []string, envKeys []string, depFiles []string, stdinSHA string) (string, KeyInputs, error) {
+	h := md5.New()
+	sh := sha256.New()
+	mw := io.MultiWriter(h, sh)
+
+	writeField := func(b []byte) {
+		fmt.Fprintf(mw, "%d:", len(b))
+		mw.Write(b)
+	}
+
+	for _, a := range args {
+		writeField([]byte(a))
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", KeyInputs{}, err
+	}
+	writeField([]byte(cwd))
+
+	meta := KeyInputs{Args: args, Cwd: cwd, EnvKeys: map[string]string{}}
+
+	for _, pattern := range envKeys {
+		for _, kv := range os.Environ() {
+			k, v := splitEnv(kv)
+			if ok, _ := filepath.Match(pattern, k); ok {
+				writeField([]byte(k))
+				writeField([]byte(v))
+				meta.EnvKeys[k] = v
+			}
+		}
+	}
+
+	if stdinSHA != "" {
+		writeField([]byte(stdinSHA))
+		meta.StdinSHA = stdinSHA
+	}
+
+	for _, depFile := range depFiles {
+		dep, err := HashDep(depFile)
+		if err != nil {
+			return "", KeyInputs{}, err
+		}
+		writeField([]byte(dep.Path))
+		writeField([]byte(fmt.Sprintf("%d", dep.Size)))
+		writeField([]byte(dep.ModTime.Format(time.RFC3339Nano)))
+		writeField([]byte(dep.SHA256))
+		meta.Deps = append(meta.Deps, dep)
+	}
+
+	meta.SHA256 = hex.EncodeToString(sh.Sum(nil))
+	return hex.EncodeToString(h.Sum(nil)), meta, nil
+}
+
+// splitEnv breaks a "KEY=VALUE" entry from os.Environ() in two.
+func splitEnv(kv string) (key, value string) {
+	if i := strings.IndexByte(kv, '='); i >= 0 {
+		return kv[:i], kv[i+1:]
+	}
+	return kv, ""
+}
+
+// WriteMeta persists which inputs produced digest, so a later
+// ReadMeta can explain the hit/miss without re-running anything.
+func WriteMeta(digest string, meta KeyInputs) error {
+	out, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(MetaPath(digest), out, 0644)
+}
+
+// ReadMeta reads back the .meta sidecar for digest.
+func ReadMeta(digest string) (KeyInputs, error) {
+	out, err := ioutil.ReadFile(MetaPath(digest))
+	if err != nil {
+		return KeyInputs{}, err
+	}
+	var meta KeyInputs
+	if err := json.Unmarshal(out, &meta); err != nil {
+		return KeyInputs{}, err
+	}
+	return meta, nil
+}
@@ -0,0 +1,379 @@
+// Package cmdcache holds the pieces of cmdcache that are useful on
+// their own: a timestamped stdout/stderr multiplexer, the on-disk
+// record formats, and a go-cmd/Cmd-style Recorder/Player pair for
+// programs that want to capture or replay a command without shelling
+// out to the cmdcache binary.
+package cmdcache
+
+// vim: ts=2 sw=2 ai
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Stream ids for a BufRecord.  ExitRecordID and ResizeRecordID live
+// alongside these so every consumer switches on one set of constants.
+const (
+	StreamStdout = 1
+	StreamStderr = 2
+)
+
+// ExitRecordID marks the record carrying the process's exit code.
+const ExitRecordID = 127
+
+// BufRecord is how we shunt data around: which stream it came from,
+// how long after the previous record it arrived, and the bytes
+// themselves.
+type BufRecord struct {
+	T   int
+	Id  int
+	Buf []byte
+}
+
+// Timestamped is the type for our timestamped stream.
+type Timestamped struct {
+	t  time.Time
+	id int
+	ch chan BufRecord
+}
+
+// OpenTS is how we setup a Timestamped stream.
+func OpenTS(id int, c chan BufRecord) *Timestamped {
+	return &Timestamped{time.Now(), id, c}
+}
+
+// Write for Timestamped stream - as this is multiplexed,
+// we send it to the channel for writing in one place.
+func (t *Timestamped) Write(d []byte) (int, error) {
+	t.emit(t.id, d)
+	return len(d), nil
+}
+
+// emit timestamps buf and sends it down the shared channel under id,
+// regardless of which lane (stdout/stderr, or something else like a
+// --pty resize record) it belongs to.
+func (t *Timestamped) emit(id int, buf []byte) {
+	tn := time.Now()
+	dif := int64(tn.Sub(t.t) / time.Millisecond)
+	t.t = tn
+	t.ch <- BufRecord{T: int(dif), Id: id, Buf: buf}
+}
+
+// DurationOf is so named because I was originally using a duration
+// type, but the way of asserting the value was so unsatisfying
+// Probably the messagepack library's fault.
+// Here I work around the whole issue that msgpack won't tell me
+// what type it's going to use to store the value by utilizing
+// printf's reflective capabilities.  Anyway, since I am now using
+// Milliseconds, it's still a duration, but not a Duration.
+func DurationOf(i interface{}) int {
+	var d int
+	// There's probably a better way.
+	s := fmt.Sprintf("%v", i)
+	fmt.Sscanf(s, "%d", &d)
+	return d
+}
+
+// Plex sequences the record into the sink for the channel.
+// This is usually the same for both stdout and stderr so that's why
+// we use the channel to keep writes coherent.
+// They need time to finish flushing so we emit a finished signal
+// which the caller blocks on.
+func Plex(sink RecordSink, ch chan BufRecord, finished chan bool, bc *WriteBroadcaster) {
+	for {
+		// Receive a record from the channel
+		rec := <-ch
+		// Fan it out to any --attach subscribers first, so they see the
+		// record at the same point in the stream as the cache file does.
+		if bc != nil {
+			bc.Feed(rec)
+		}
+		if err := sink.WriteRecord(rec); err == nil {
+			// If this is the exit code, we're done.
+			if rec.Id == ExitRecordID {
+				// Signal the end so that we can wait for it.
+				finished <- true
+				return
+			}
+		}
+	}
+}
+
+// Status is a snapshot of a Recorder's progress: accumulated output
+// on each stream plus the exit code once the command has finished.
+type Status struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+	Err      error
+}
+
+// Recorder runs a single command, multiplexing its stdout/stderr into
+// a timestamped BufRecord stream - modeled on go-cmd/Cmd's API so
+// embedders who don't need cmdcache's caching, replay or on-disk
+// formats can still use the capture side of it directly.  The cmdcache
+// CLI itself is a thin wrapper around a Recorder: it just points Stdin
+// at the right source, picks a RecordSink for --format, and feeds
+// Stream() to that sink and to --serve's broadcaster as records arrive.
+type Recorder struct {
+	name string
+	args []string
+
+	// Stdin, if non-nil, becomes the child's standard input. Left nil,
+	// the child reads from the null device, same as exec.Cmd's own zero
+	// value - or, with PTY set, from the pseudo-terminal.
+	Stdin io.Reader
+
+	// PTY runs the child attached to a pseudo-terminal instead of
+	// plain pipes, for isatty-sensitive programs - see RunPTY.
+	PTY bool
+
+	// Timeout and KillAfter are passed straight through to Supervise:
+	// SIGTERM the child once Timeout elapses, then SIGKILL it
+	// KillAfter after that if it's still alive.
+	Timeout, KillAfter time.Duration
+
+	cmd *exec.Cmd
+
+	mu     sync.Mutex
+	status Status
+
+	stream chan BufRecord
+	done   chan Status
+}
+
+// New prepares a Recorder for name with args, ready for Start.
+func New(name string, args ...string) *Recorder {
+	return &Recorder{name: name, args: args}
+}
+
+// Stream returns the channel of BufRecords as they're produced, for
+// real-time consumption alongside the accumulated Status.
+func (r *Recorder) Stream() <-chan BufRecord {
+	return r.stream
+}
+
+// Start runs the command and returns a channel that receives the
+// final Status once it exits.
+func (r *Recorder) Start() <-chan Status {
+	ch := make(chan BufRecord)
+	r.stream = make(chan BufRecord, 16)
+	r.done = make(chan Status, 1)
+	r.cmd = exec.Command(r.name, r.args...)
+	r.cmd.Stdin = r.Stdin
+
+	go r.collect(ch)
+
+	stdoutTS := OpenTS(StreamStdout, ch)
+	if r.PTY {
+		go r.runPTY(stdoutTS, ch)
+		return r.done
+	}
+
+	stdoutIn, _ := r.cmd.StdoutPipe()
+	stderrIn, _ := r.cmd.StderrPipe()
+	stderrTS := OpenTS(StreamStderr, ch)
+
+	if err := r.cmd.Start(); err != nil {
+		r.mu.Lock()
+		r.status.Err = err
+		r.mu.Unlock()
+		ch <- BufRecord{Id: ExitRecordID, Buf: []byte{1}}
+		return r.done
+	}
+	stop := Supervise(r.cmd.Process.Pid, stdoutTS, r.Timeout, r.KillAfter)
+
+	var copyWG sync.WaitGroup
+	var errStdout, errStderr error
+	copyWG.Add(2)
+	go func() {
+		defer copyWG.Done()
+		_, errStdout = io.Copy(stdoutTS, stdoutIn)
+	}()
+	go func() {
+		defer copyWG.Done()
+		_, errStderr = io.Copy(stderrTS, stderrIn)
+	}()
+
+	go func() {
+		// Let the copies reach their own io.EOF before Wait closes the
+		// pipes out from under them.
+		copyWG.Wait()
+		err := r.cmd.Wait()
+		stop()
+		if cerr := firstCopyErr(errStdout, errStderr); cerr != nil {
+			r.mu.Lock()
+			r.status.Err = cerr
+			r.mu.Unlock()
+		}
+		ch <- BufRecord{Id: ExitRecordID, Buf: []byte{byte(exitCodeOf(err))}}
+	}()
+
+	return r.done
+}
+
+// runPTY drives the PTY-backed capture path, mirroring the pipe path's
+// Supervise wiring and exit-code translation.
+func (r *Recorder) runPTY(ts *Timestamped, ch chan BufRecord) {
+	var stop func()
+	err := RunPTY(r.cmd, ts, func(pid int) func() {
+		stop = Supervise(pid, ts, r.Timeout, r.KillAfter)
+		return stop
+	})
+	if err != nil {
+		r.mu.Lock()
+		r.status.Err = err
+		r.mu.Unlock()
+		ch <- BufRecord{Id: ExitRecordID, Buf: []byte{1}}
+		return
+	}
+	waitErr := r.cmd.Wait()
+	ch <- BufRecord{Id: ExitRecordID, Buf: []byte{byte(exitCodeOf(waitErr))}}
+}
+
+// firstCopyErr returns whichever of errStdout/errStderr is a real
+// failure, treating io.EOF (the ordinary way a copy ends) as no error.
+func firstCopyErr(errStdout, errStderr error) error {
+	if errStdout != nil && errStdout != io.EOF {
+		return errStdout
+	}
+	if errStderr != nil && errStderr != io.EOF {
+		return errStderr
+	}
+	return nil
+}
+
+// exitCodeOf translates a cmd.Wait() error into an exit code: the
+// process's own exit status, or 128+signal if it was killed by one
+// (matching the shell).
+func exitCodeOf(err error) int {
+	exiterr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0
+	}
+	status, ok := exiterr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return 0
+	}
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// collect accumulates each record into the running Status, forwards
+// it on Stream, and delivers the final Status on done once the exit
+// record comes through.
+func (r *Recorder) collect(ch chan BufRecord) {
+	for rec := range ch {
+		r.mu.Lock()
+		switch rec.Id {
+		case StreamStdout:
+			r.status.Stdout = append(r.status.Stdout, rec.Buf...)
+		case StreamStderr:
+			r.status.Stderr = append(r.status.Stderr, rec.Buf...)
+		case ExitRecordID:
+			if len(rec.Buf) > 0 {
+				r.status.ExitCode = int(rec.Buf[0])
+			}
+		}
+		status := r.status
+		r.mu.Unlock()
+
+		r.stream <- rec
+		if rec.Id == ExitRecordID {
+			close(r.stream)
+			r.done <- status
+			return
+		}
+	}
+}
+
+// Status returns a snapshot of accumulated output and exit code so far.
+func (r *Recorder) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Status{
+		Stdout:   append([]byte{}, r.status.Stdout...),
+		Stderr:   append([]byte{}, r.status.Stderr...),
+		ExitCode: r.status.ExitCode,
+		Err:      r.status.Err,
+	}
+}
+
+// Stop asks the running command to terminate.
+func (r *Recorder) Stop() error {
+	if r.cmd == nil || r.cmd.Process == nil {
+		return nil
+	}
+	return r.cmd.Process.Signal(syscall.SIGTERM)
+}
+
+// Player replays a cmdcache recording, native or asciicast, without
+// the caller needing to know which format produced it.
+type Player struct {
+	closer io.Closer
+	next   func() (BufRecord, bool)
+}
+
+// Open reads the cache file at path and sniffs its format.
+func Open(path string) (*Player, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	next, err := OpenRecordStream(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Player{closer: f, next: next}, nil
+}
+
+// Next returns the next BufRecord in the recording, or io.EOF once
+// the stream is exhausted.
+func (p *Player) Next() (BufRecord, error) {
+	rec, ok := p.next()
+	if !ok {
+		return BufRecord{}, io.EOF
+	}
+	return rec, nil
+}
+
+// Close releases the underlying file.
+func (p *Player) Close() error {
+	return p.closer.Close()
+}
+
+// Play drives stdout/stderr records to the given writers until the
+// stream is exhausted or the exit record is reached.  When realtime
+// is true it sleeps between records the same way --delay does, so
+// the output paces itself like the original run.
+func (p *Player) Play(stdout, stderr io.Writer, realtime bool) error {
+	for {
+		rec, err := p.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if realtime {
+			time.Sleep(time.Duration(rec.T) * time.Millisecond)
+		}
+		switch rec.Id {
+		case StreamStdout:
+			stdout.Write(rec.Buf)
+		case StreamStderr:
+			stderr.Write(rec.Buf)
+		case ExitRecordID:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package cmdcache
+
+// vim: ts=2 sw=2 ai
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestRecorderCaptures exercises Recorder end to end: Start a real
+// command, drain Stream(), and check the final Status matches what
+// the command actually did - the path the CLI now drives directly
+// instead of hand-rolling its own exec.Cmd/Supervise wiring.
+func TestRecorderCaptures(t *testing.T) {
+	r := New("sh", "-c", "echo out; echo err 1>&2; exit 3")
+	done := r.Start()
+	for range r.Stream() {
+	}
+	status := <-done
+
+	if status.ExitCode != 3 {
+		t.Errorf("ExitCode = %d, want 3", status.ExitCode)
+	}
+	if got := strings.TrimSpace(string(status.Stdout)); got != "out" {
+		t.Errorf("Stdout = %q, want %q", got, "out")
+	}
+	if got := strings.TrimSpace(string(status.Stderr)); got != "err" {
+		t.Errorf("Stderr = %q, want %q", got, "err")
+	}
+}
+
+// TestRecorderStdin checks that Stdin is wired through to the child,
+// the way the CLI relies on it for replaying buffered --hash-stdin
+// input.
+func TestRecorderStdin(t *testing.T) {
+	r := New("cat")
+	r.Stdin = strings.NewReader("fed in\n")
+	done := r.Start()
+	for range r.Stream() {
+	}
+	status := <-done
+
+	if got := string(status.Stdout); got != "fed in\n" {
+		t.Errorf("Stdout = %q, want %q", got, "fed in\n")
+	}
+	if status.ExitCode != 0 {
+		t.Errorf("ExitCode = %d, want 0", status.ExitCode)
+	}
+}
@@ -0,0 +1,231 @@
+package cmdcache
+
+// vim: ts=2 sw=2 ai
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// RecordSink is how Plex persists each BufRecord - the native
+// msgpack/gzip format and the asciicast format both implement it, so
+// Plex doesn't need to know which one it's feeding.
+type RecordSink interface {
+	WriteRecord(rec BufRecord) error
+}
+
+// NativeSink is the original format: each record msgpack-marshaled
+// straight onto the (usually gzip) writer underneath.
+type NativeSink struct{ W io.Writer }
+
+func (s NativeSink) WriteRecord(rec BufRecord) error {
+	out, err := msgpack.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = s.W.Write(out)
+	return err
+}
+
+// ExtensionFor returns the cache filename extension for the given
+// --format value, so native and asciicast captures of the same
+// command never collide on disk.
+func ExtensionFor(format string) string {
+	if format == "asciicast" {
+		return ".cast"
+	}
+	return ".ts"
+}
+
+// CastHeader is the asciicast v2 header line: a single JSON object
+// that precedes the newline-delimited event stream.
+type CastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// termSize asks the terminal attached to stdout for its dimensions,
+// falling back to a plausible default when stdout isn't a tty.
+func termSize() (width, height int) {
+	type winsize struct {
+		Row, Col, Xpixel, Ypixel uint16
+	}
+	var ws winsize
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(),
+		syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 || ws.Col == 0 {
+		return 80, 24
+	}
+	return int(ws.Col), int(ws.Row)
+}
+
+// CastSink writes BufRecords out as an asciicast v2 stream: the header
+// line followed by one JSON event array per record.  Id=StreamStdout/
+// Id=StreamStderr become the "o"/"e" event codes, a resize record
+// becomes asciicast's own "r" event, and the Id=ExitRecordID record is
+// translated into an "exit" event (an asciinema extension) instead of
+// being dropped, so replay can still recover the exit code.
+type CastSink struct {
+	w     io.Writer
+	start time.Time
+}
+
+// NewCastSink writes the asciicast header for a capture that started
+// at start and returns a sink ready to stream events.
+func NewCastSink(w io.Writer, start time.Time) (*CastSink, error) {
+	width, height := termSize()
+	header := CastHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: start.Unix(),
+		Env:       map[string]string{"SHELL": os.Getenv("SHELL"), "TERM": os.Getenv("TERM")},
+	}
+	line, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", line); err != nil {
+		return nil, err
+	}
+	return &CastSink{w: w, start: start}, nil
+}
+
+// WriteRecord stamps each event with a monotonically increasing
+// seconds-since-start float, as asciicast expects, taken from the wall
+// clock when the record is written rather than from rec's T delta.
+func (s *CastSink) WriteRecord(rec BufRecord) error {
+	elapsed := time.Since(s.start).Seconds()
+	var event []interface{}
+	switch rec.Id {
+	case StreamStdout:
+		event = []interface{}{elapsed, "o", string(rec.Buf)}
+	case StreamStderr:
+		event = []interface{}{elapsed, "e", string(rec.Buf)}
+	case ResizeRecordID:
+		var ws WinSize
+		if err := msgpack.Unmarshal(rec.Buf, &ws); err != nil {
+			return nil
+		}
+		event = []interface{}{elapsed, "r", fmt.Sprintf("%dx%d", ws.Cols, ws.Rows)}
+	case ExitRecordID:
+		event = []interface{}{elapsed, "exit", fmt.Sprintf("%d", rec.Buf[0])}
+	case SignalRecordID:
+		ti, err := DecodeTermInfo(rec.Buf)
+		if err != nil {
+			return nil
+		}
+		event = []interface{}{elapsed, "signal", fmt.Sprintf("%d", ti.Signal)}
+	default:
+		return nil
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.w, "%s\n", line)
+	return err
+}
+
+// openCastStream reads back a .cast file and hands out BufRecords one
+// at a time via next(), reconstructing the same stream that drives a
+// replay loop, so callers don't need to know the records came from
+// asciicast rather than the native format.
+func openCastStream(r io.Reader) (next func() (BufRecord, bool), err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("empty .cast stream")
+	}
+	var header CastHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return nil, err
+	}
+	var last float64
+	next = func() (BufRecord, bool) {
+		if !scanner.Scan() {
+			return BufRecord{}, false
+		}
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return BufRecord{}, false
+		}
+		t, _ := event[0].(float64)
+		kind, _ := event[1].(string)
+		payload, _ := event[2].(string)
+		dif := int((t - last) * 1000)
+		last = t
+		switch kind {
+		case "o":
+			return BufRecord{T: dif, Id: StreamStdout, Buf: []byte(payload)}, true
+		case "e":
+			return BufRecord{T: dif, Id: StreamStderr, Buf: []byte(payload)}, true
+		case "exit":
+			var code int
+			fmt.Sscanf(payload, "%d", &code)
+			return BufRecord{T: dif, Id: ExitRecordID, Buf: []byte{byte(code)}}, true
+		case "r":
+			var cols, rows int
+			fmt.Sscanf(payload, "%dx%d", &cols, &rows)
+			buf, _ := msgpack.Marshal(WinSize{Rows: uint16(rows), Cols: uint16(cols)})
+			return BufRecord{T: dif, Id: ResizeRecordID, Buf: buf}, true
+		case "signal":
+			var sig int
+			fmt.Sscanf(payload, "%d", &sig)
+			buf, _ := msgpack.Marshal(TermInfo{Signal: sig, Signaled: true})
+			return BufRecord{T: dif, Id: SignalRecordID, Buf: buf}, true
+		default:
+			// Unknown event extension: skip it rather than choke on it.
+			return next()
+		}
+	}
+	return next, nil
+}
+
+// openNativeStream reads back the original gzip+msgpack format,
+// handing out BufRecords the same way openCastStream does.
+func openNativeStream(r io.Reader) (next func() (BufRecord, bool), err error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	mp := msgpack.NewDecoder(gz)
+	next = func() (BufRecord, bool) {
+		var rec BufRecord
+		if err := mp.Decode(&rec); err != nil {
+			return BufRecord{}, false
+		}
+		return rec, true
+	}
+	return next, nil
+}
+
+// OpenRecordStream sniffs r's first byte to tell the native gzip
+// format (always starts with the gzip magic) from an asciicast v2
+// stream (always starts with a JSON object), so replay works
+// regardless of which --format produced the file on disk.
+func OpenRecordStream(r io.ReadSeeker) (next func() (BufRecord, bool), err error) {
+	var buf [1]byte
+	if _, err := r.Read(buf[:]); err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if buf[0] == '{' {
+		return openCastStream(r)
+	}
+	return openNativeStream(r)
+}
@@ -0,0 +1,51 @@
+package cmdcache
+
+// vim: ts=2 sw=2 ai
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+)
+
+// TestNativeRoundTrip captures a handful of records through NativeSink
+// and reads them back through OpenRecordStream, guarding against a
+// regression of the Id-type mismatch that used to panic every native
+// replay (BufRecord.Id round-trips through msgpack as int64, not the
+// int8 a naive map assertion expects).
+func TestNativeRoundTrip(t *testing.T) {
+	want := []BufRecord{
+		{T: 0, Id: StreamStdout, Buf: []byte("hello\n")},
+		{T: 12, Id: StreamStderr, Buf: []byte("oops\n")},
+		{T: 34, Id: ExitRecordID, Buf: []byte{0}},
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	sink := NativeSink{W: gz}
+	for _, rec := range want {
+		if err := sink.WriteRecord(rec); err != nil {
+			t.Fatalf("WriteRecord(%+v): %v", rec, err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gz.Close(): %v", err)
+	}
+
+	next, err := OpenRecordStream(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("OpenRecordStream: %v", err)
+	}
+	var got []BufRecord
+	for {
+		rec, ok := next()
+		if !ok {
+			break
+		}
+		got = append(got, rec)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round-trip mismatch:\n got:  %+v\n want: %+v", got, want)
+	}
+}
@@ -0,0 +1,112 @@
+package cmdcache
+
+// vim: ts=2 sw=2 ai
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/creack/pty"
+	"github.com/vmihailenco/msgpack"
+)
+
+// ResizeRecordID is a BufRecord.Id dedicated to terminal dimensions,
+// alongside StreamStdout, StreamStderr and ExitRecordID.
+const ResizeRecordID = 3
+
+// WinSize is the handful of terminal dimensions worth recording, so
+// replay can re-issue a resize escape before the output that follows
+// it, preserving the appearance of curses/TUI programs.
+type WinSize struct {
+	Rows uint16
+	Cols uint16
+}
+
+// RunPTY starts cmd attached to a new pseudo-terminal instead of the
+// plain stdout/stderr pipes, so programs that check isatty (ls
+// colorization, progress bars, pagers) render the way they would in
+// an interactive shell.  The merged pty output flows through ts as a
+// single lane - once a pty is in the picture the child can no longer
+// tell stdout from stderr apart, so there is no separate stderr lane
+// to split out here.
+//
+// If onStart is non-nil, it's called with the child's pid as soon as
+// it's running (e.g. to install Supervise), and its returned stop func,
+// if any, is called once RunPTY is done blocking on the child's output.
+func RunPTY(cmd *exec.Cmd, ts *Timestamped, onStart func(pid int) (stop func())) error {
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		return err
+	}
+	defer ptmx.Close()
+
+	var stop func()
+	if onStart != nil {
+		stop = onStart(cmd.Process.Pid)
+	}
+
+	// Forward SIGWINCH from our own controlling terminal through to
+	// the child for as long as it's alive, recording each size change
+	// so replay can reproduce it.
+	sizeCh := make(chan os.Signal, 1)
+	signal.Notify(sizeCh, syscall.SIGWINCH)
+	defer signal.Stop(sizeCh)
+	resize := func() {
+		if err := pty.InheritSize(os.Stdin, ptmx); err != nil {
+			return
+		}
+		if ws, err := pty.GetsizeFull(ptmx); err == nil {
+			recordResize(ts, ws.Rows, ws.Cols)
+		}
+	}
+	resize() // record the starting size before any output flows
+	go func() {
+		for range sizeCh {
+			resize()
+		}
+	}()
+
+	go io.Copy(ptmx, os.Stdin)
+	_, err = io.Copy(ts, ptmx)
+	if stop != nil {
+		stop()
+	}
+	if errors.Is(err, syscall.EIO) {
+		// On Linux, reading the pty master once the child's slave side
+		// has closed always surfaces as EIO rather than io.EOF - the
+		// ordinary way a pty session ends, not an actual failure.
+		err = nil
+	}
+	return err
+}
+
+// recordResize pushes a resize BufRecord through the same channel as
+// stdout, so it's sequenced correctly relative to the output around it.
+func recordResize(ts *Timestamped, rows, cols uint16) {
+	buf, err := msgpack.Marshal(WinSize{Rows: rows, Cols: cols})
+	if err != nil {
+		return
+	}
+	ts.emit(ResizeRecordID, buf)
+}
+
+// DecodeResize unmarshals a resize BufRecord's payload back into a
+// WinSize, so callers outside this package don't need to know it's
+// msgpack underneath.
+func DecodeResize(buf []byte) (WinSize, error) {
+	var ws WinSize
+	err := msgpack.Unmarshal(buf, &ws)
+	return ws, err
+}
+
+// ResizeEscape renders the xterm/tmux "resize window" control sequence
+// for ws, which replay emits in place of the original SIGWINCH so a
+// curses/TUI program re-draws at the recorded size.
+func ResizeEscape(ws WinSize) string {
+	return fmt.Sprintf("\x1b[8;%d;%dt", ws.Rows, ws.Cols)
+}
@@ -0,0 +1,102 @@
+package cmdcache
+
+// vim: ts=2 sw=2 ai
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// SignalRecordID marks the record carrying why a run was signaled
+// (timeout or a forwarded signal), alongside ExitRecordID for the
+// normal "the process exited" record.
+const SignalRecordID = 126
+
+// TermInfo is what we remember about a signal delivered to the child,
+// so replay can explain an exit code that came from a signal rather
+// than a plain exit(2) call.
+type TermInfo struct {
+	Signal   int
+	Signaled bool
+}
+
+// DecodeTermInfo unmarshals a SignalRecordID payload back into a
+// TermInfo, so callers outside this package don't need to know it's
+// msgpack underneath.
+func DecodeTermInfo(buf []byte) (TermInfo, error) {
+	var ti TermInfo
+	err := msgpack.Unmarshal(buf, &ti)
+	return ti, err
+}
+
+// Supervise forwards SIGINT/SIGTERM/SIGHUP/SIGQUIT received by our own
+// process on to pid, and, when timeout is positive, sends pid a SIGTERM
+// once timeout has elapsed followed by a SIGKILL after killAfter more
+// (when killAfter is also positive). Every signal it sends is recorded
+// through ts so replay can reproduce why the run ended.
+//
+// Signals are delivered with syscall.Kill(pid, sig) rather than
+// cmd.Process.Signal, which loses the race against the process already
+// having been reaped once Wait returns - see the caller's stop func,
+// which must be invoked as soon as Wait returns to close that window.
+func Supervise(pid int, ts *Timestamped, timeout, killAfter time.Duration) (stop func()) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+
+	done := make(chan struct{})
+	var timerMu sync.Mutex
+	var timeoutTimer, killTimer *time.Timer
+	if timeout > 0 {
+		timeoutTimer = time.AfterFunc(timeout, func() {
+			signalPid(ts, pid, syscall.SIGTERM)
+			if killAfter > 0 {
+				t := time.AfterFunc(killAfter, func() {
+					signalPid(ts, pid, syscall.SIGKILL)
+				})
+				timerMu.Lock()
+				killTimer = t
+				timerMu.Unlock()
+			}
+		})
+	}
+
+	go func() {
+		for {
+			select {
+			case sig := <-sigCh:
+				signalPid(ts, pid, sig.(syscall.Signal))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		signal.Stop(sigCh)
+		if timeoutTimer != nil {
+			timeoutTimer.Stop()
+		}
+		timerMu.Lock()
+		defer timerMu.Unlock()
+		if killTimer != nil {
+			killTimer.Stop()
+		}
+	}
+}
+
+// signalPid delivers sig to pid directly and records it as a
+// SignalRecordID, sequenced against whatever else ts is timestamping.
+func signalPid(ts *Timestamped, pid int, sig syscall.Signal) {
+	syscall.Kill(pid, sig)
+	buf, err := msgpack.Marshal(TermInfo{Signal: int(sig), Signaled: true})
+	if err != nil {
+		return
+	}
+	ts.emit(SignalRecordID, buf)
+}
@@ -0,0 +1,35 @@
+package main
+
+// vim: ts=2 sw=2 ai
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	cc "github.com/fayep/cmdcache/pkg/cmdcache"
+)
+
+// doWhy reads back the .meta sidecar for hash and prints what went
+// into its cache key.
+func doWhy(hash string) {
+	meta, err := cc.ReadMeta(hash)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cmdcache: no recorded inputs for %s (%s)\n", hash, err)
+		panic(Exit{1})
+	}
+	fmt.Printf("command: %s\n", strings.Join(meta.Args, " "))
+	fmt.Printf("cwd:     %s\n", meta.Cwd)
+	for k, v := range meta.EnvKeys {
+		fmt.Printf("env:     %s=%s\n", k, v)
+	}
+	if meta.StdinSHA != "" {
+		fmt.Printf("stdin:   sha256:%s\n", meta.StdinSHA)
+	}
+	for _, dep := range meta.Deps {
+		fmt.Printf("dep:     %s (%d bytes, modified %s, sha256:%s)\n",
+			dep.Path, dep.Size, dep.ModTime.Format(time.RFC3339), dep.SHA256)
+	}
+	panic(Exit{0})
+}